@@ -0,0 +1,218 @@
+package rsync
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"bitbucket.org/kardianos/rsync"
+)
+
+const (
+	// defaultBulkDeltaThreshold is the base file size, in bytes, above
+	// which StageBulk requests an rsync delta for an entry instead of
+	// having it sent whole inside the tar stream.
+	defaultBulkDeltaThreshold = 32 * 1024
+
+	// bulkDeltaPAXRecord is the tar PAX extended header record used to mark
+	// an entry as carrying a sequence of gob-encoded rsync.Operation values
+	// rather than the file's contents directly.
+	bulkDeltaPAXRecord = "rsync.delta"
+)
+
+// BulkOptions controls the behavior of Client.StageBulk.
+type BulkOptions struct {
+	// DeltaThreshold is the base file size above which an entry is synced
+	// via an rsync delta rather than sent whole. If zero,
+	// defaultBulkDeltaThreshold is used.
+	DeltaThreshold int64
+
+	// Progress, if non-nil, is invoked once per entry as it finishes
+	// staging, mirroring StageOptions.Progress but without the
+	// per-operation granularity StageOptions.Progress gets from a
+	// single-file rsync delta.
+	Progress ProgressCallback
+}
+
+// bulkPathRequest names one file StageBulk wants, along with the signature
+// of the client's base copy so the server can compute a delta for it if it
+// decides the entry is worth one.
+type bulkPathRequest struct {
+	Path          Path
+	BaseSignature []rsync.BlockHash
+}
+
+// bulkRequest is the message a Client sends to start a tar-stream staging
+// run. The server replies with a single tar stream, one entry per Paths,
+// in order, in the same connection; the entry's PAX header named by
+// bulkDeltaPAXRecord tells the client whether it holds the file whole or an
+// rsync delta against the corresponding BaseSignature.
+type bulkRequest struct {
+	Paths          []bulkPathRequest
+	DeltaThreshold int64
+}
+
+// StageBulk stages many files in a single tar stream instead of one
+// request/response cycle per path, which is far cheaper when paths names a
+// large number of small files (e.g. a directory of shims). The server
+// decides, per entry, whether to send the file whole or as an rsync delta
+// by comparing its size against options.DeltaThreshold.
+//
+// StageBulk uses its own rsyncer and hasher fields, separate from Stage's,
+// but a Client still may not have a Stage and a StageBulk call (or two
+// StageBulk calls) running at the same time; see Stage's doc comment.
+//
+// TODO: The server-side counterpart that writes the tar.Writer isn't
+// present in this package snapshot (see the Server type referenced in
+// rsync_test.go); this implements the client's half of the protocol.
+func (c *Client) StageBulk(ctx context.Context, paths []Path, options BulkOptions) error {
+	threshold := options.DeltaThreshold
+	if threshold == 0 {
+		threshold = defaultBulkDeltaThreshold
+	}
+
+	// Compute each path's base signature for the request up front, but
+	// open (and close) each base one at a time rather than holding every
+	// base file open for the lifetime of the whole call: for "a large
+	// number of small files", the very case this method exists for,
+	// keeping hundreds of file descriptors open at once for the whole
+	// transfer is far more expensive than the occasional reopen below.
+	requestPaths := make([]bulkPathRequest, 0, len(paths))
+	for _, path := range paths {
+		requestPaths = append(requestPaths, bulkPathRequest{path, c.bulkBaseSignature(path)})
+	}
+
+	if err := c.stream.Encode(bulkRequest{requestPaths, threshold}); err != nil {
+		return err
+	}
+
+	// The tar stream rides directly on the Stream's frameConn rather than
+	// through its gob Encoder/Decoder, since tar wants a plain byte stream
+	// and frameConn already reassembles frames into one regardless of the
+	// sizes tar.Reader asks for.
+	reader := tar.NewReader(c.stream.conn)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		path := Path(strings.Split(header.Name, "/"))
+		base := c.openBulkBase(path)
+		err = c.stageBulkEntry(header, reader, base)
+		base.Close()
+		if err != nil {
+			return err
+		}
+
+		if options.Progress != nil {
+			options.Progress(path, header.Size, header.Size, 1)
+		}
+	}
+}
+
+// openBulkBase opens path's base file for a StageBulk request or entry,
+// falling back to an empty base (as dispatch does for ordinary staging) if
+// it doesn't exist.
+func (c *Client) openBulkBase(path Path) readSeekCloser {
+	f, err := os.Open(path.AppendedToRoot(c.root))
+	if err != nil {
+		return newEmptyReadSeekCloser()
+	}
+	return f
+}
+
+// bulkBaseSignature computes path's base signature for inclusion in a
+// bulkRequest, opening (and closing) its base file just long enough to do
+// so rather than holding it open until the corresponding tar entry arrives.
+func (c *Client) bulkBaseSignature(path Path) []rsync.BlockHash {
+	base := c.openBulkBase(path)
+	defer base.Close()
+
+	var signature []rsync.BlockHash
+	writer := func(b rsync.BlockHash) error {
+		signature = append(signature, b)
+		return nil
+	}
+	if c.bulkDispatchRsyncer.CreateSignature(base, writer) != nil {
+		signature = nil
+	}
+	return signature
+}
+
+// stageBulkEntry applies a single tar entry (either a whole file or an
+// rsync delta, per header's PAX records) into a fresh staging file, and
+// renames it into place by content digest exactly as receive does.
+func (c *Client) stageBulkEntry(header *tar.Header, entry io.Reader, base readSeekCloser) error {
+	target, err := ioutil.TempFile(c.staging, stagingTempFileBaseName)
+	if err != nil {
+		return err
+	}
+
+	c.bulkStagingHash.Reset()
+
+	if header.PAXRecords[bulkDeltaPAXRecord] == "1" {
+		err = c.applyBulkDelta(entry, base, target)
+	} else {
+		_, err = io.Copy(io.MultiWriter(target, c.bulkStagingHash), entry)
+	}
+
+	target.Close()
+	if err != nil {
+		os.Remove(target.Name())
+		return err
+	}
+
+	name := fmt.Sprintf("%x", c.bulkStagingHash.Sum(nil))
+	return c.cache.withDirLock(func() error {
+		if cached, ok := c.cache.Lookup(name); ok {
+			cached.Close()
+			os.Remove(target.Name())
+			return nil
+		}
+		return os.Rename(target.Name(), filepath.Join(c.staging, name))
+	})
+}
+
+// applyBulkDelta decodes a sequence of gob-encoded response values (the
+// same wire type used for single-file staging) from entry and applies them
+// against base, writing the reconstructed file to output and accumulating
+// its digest into c.bulkStagingHash.
+func (c *Client) applyBulkDelta(entry io.Reader, base readSeekCloser, output io.Writer) error {
+	decoder := gob.NewDecoder(entry)
+	operations := make(chan rsync.Operation)
+	applyErrors := make(chan error, 1)
+	go func() {
+		applyErrors <- c.bulkReceiveRsyncer.ApplyDelta(output, base, operations, c.bulkStagingHash)
+	}()
+
+	for {
+		var response response
+		if err := decoder.Decode(&response); err != nil {
+			close(operations)
+			<-applyErrors
+			return err
+		}
+		if response.Done {
+			break
+		}
+		operations <- response.Operation
+	}
+
+	close(operations)
+	return <-applyErrors
+}
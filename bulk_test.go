@@ -0,0 +1,211 @@
+package rsync
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"bitbucket.org/kardianos/rsync"
+)
+
+// TestBulkPathTarNameRoundTrip exercises the Path <-> tar entry name
+// conversion StageBulk relies on (path.String() to form an entry's name, and
+// strings.Split(header.Name, "/") to turn a returned entry's name back into
+// the Path whose base it opens), since tar headers only carry a flat name.
+func TestBulkPathTarNameRoundTrip(t *testing.T) {
+	original := Path{"bin", "sub", "tool"}
+
+	name := original.String()
+	recovered := Path(strings.Split(name, "/"))
+
+	if len(recovered) != len(original) {
+		t.Fatalf("expected %d components, got %d", len(original), len(recovered))
+	}
+	for i := range original {
+		if recovered[i] != original[i] {
+			t.Errorf("component %d: expected %q, got %q", i, original[i], recovered[i])
+		}
+	}
+}
+
+func TestBulkPathTarNameRoundTripSingleComponent(t *testing.T) {
+	original := Path{"tool"}
+
+	recovered := Path(strings.Split(original.String(), "/"))
+	if len(recovered) != 1 || recovered[0] != "tool" {
+		t.Errorf("expected a single \"tool\" component, got %v", recovered)
+	}
+}
+
+// newTestBulkClient creates a Client with just enough state populated for
+// stageBulkEntry/applyBulkDelta to run - no Stream, since neither method
+// touches it - backed by a fresh staging directory that the caller is
+// responsible for removing.
+func newTestBulkClient(t *testing.T) (*Client, string) {
+	t.Helper()
+
+	staging, err := ioutil.TempDir("", "rsync-bulk")
+	if err != nil {
+		t.Fatal("couldn't create temporary staging directory:", err)
+	}
+
+	return &Client{
+		staging:             staging,
+		cache:               NewStagingCache(staging),
+		bulkDispatchRsyncer: newRsyncer(sha256.New),
+		bulkReceiveRsyncer:  newRsyncer(sha256.New),
+		bulkStagingHash:     sha256.New(),
+	}, staging
+}
+
+// stagedDigest returns the hex digest under which content would be staged.
+func stagedDigest(content []byte) string {
+	hasher := sha256.New()
+	hasher.Write(content)
+	return fmt.Sprintf("%x", hasher.Sum(nil))
+}
+
+// TestStageBulkEntryWhole drives a whole-file (non-delta) tar entry through
+// stageBulkEntry, the branch StageBulk takes for files below its delta
+// threshold.
+func TestStageBulkEntryWhole(t *testing.T) {
+	c, staging := newTestBulkClient(t)
+	defer os.RemoveAll(staging)
+
+	content := []byte("whole file contents, sent verbatim")
+	header := &tar.Header{Name: "bin/tool", PAXRecords: map[string]string{}}
+
+	if err := c.stageBulkEntry(header, bytes.NewReader(content), newEmptyReadSeekCloser()); err != nil {
+		t.Fatal("stageBulkEntry failed:", err)
+	}
+
+	staged, err := ioutil.ReadFile(c.staging + "/" + stagedDigest(content))
+	if err != nil {
+		t.Fatal("staged file not found at expected digest path:", err)
+	}
+	if !bytes.Equal(staged, content) {
+		t.Errorf("staged content %q did not match original %q", staged, content)
+	}
+}
+
+// TestStageBulkEntryWholeDedupesAgainstCache stages the same content twice
+// and verifies the second call finds it already cached (via Lookup) rather
+// than renaming a second copy into place.
+func TestStageBulkEntryWholeDedupesAgainstCache(t *testing.T) {
+	c, staging := newTestBulkClient(t)
+	defer os.RemoveAll(staging)
+
+	content := []byte("shared content staged by two entries")
+	header := &tar.Header{Name: "bin/a", PAXRecords: map[string]string{}}
+
+	if err := c.stageBulkEntry(header, bytes.NewReader(content), newEmptyReadSeekCloser()); err != nil {
+		t.Fatal("first stageBulkEntry failed:", err)
+	}
+
+	digestPath := c.staging + "/" + stagedDigest(content)
+	info, err := os.Stat(digestPath)
+	if err != nil {
+		t.Fatal("staged file not found after first entry:", err)
+	}
+
+	header = &tar.Header{Name: "bin/b", PAXRecords: map[string]string{}}
+	if err := c.stageBulkEntry(header, bytes.NewReader(content), newEmptyReadSeekCloser()); err != nil {
+		t.Fatal("second stageBulkEntry failed:", err)
+	}
+
+	again, err := os.Stat(digestPath)
+	if err != nil {
+		t.Fatal("staged file disappeared after second entry:", err)
+	}
+	if !again.ModTime().Equal(info.ModTime()) {
+		t.Error("second stageBulkEntry overwrote the cached entry instead of deduping against it")
+	}
+}
+
+// buildBulkDeltaEntry computes a signature for base, creates a delta from
+// target against it using a throwaway RSync (standing in for the server
+// side of the protocol), and gob-encodes the resulting operations the same
+// way a bulkDeltaPAXRecord tar entry carries them.
+func buildBulkDeltaEntry(t *testing.T, base, target []byte) *bytes.Buffer {
+	t.Helper()
+
+	server := newRsyncer(sha256.New)
+
+	var signature []rsync.BlockHash
+	if err := server.CreateSignature(bytes.NewReader(base), func(b rsync.BlockHash) error {
+		signature = append(signature, b)
+		return nil
+	}); err != nil {
+		t.Fatal("CreateSignature failed:", err)
+	}
+
+	buffer := &bytes.Buffer{}
+	encoder := gob.NewEncoder(buffer)
+	writer := func(op rsync.Operation) error {
+		return encoder.Encode(response{Operation: op})
+	}
+	if err := server.CreateDelta(bytes.NewReader(target), signature, writer, nil); err != nil {
+		t.Fatal("CreateDelta failed:", err)
+	}
+	if err := encoder.Encode(response{Done: true}); err != nil {
+		t.Fatal("couldn't encode terminating response:", err)
+	}
+
+	return buffer
+}
+
+// TestStageBulkEntryDeltaFromEmptyBase exercises the delta branch of
+// stageBulkEntry when the base is empty (the case dispatch/openBulkBase
+// fall back to for a path with no local copy), which forces every
+// operation to carry literal data rather than reference a base block.
+func TestStageBulkEntryDeltaFromEmptyBase(t *testing.T) {
+	c, staging := newTestBulkClient(t)
+	defer os.RemoveAll(staging)
+
+	target := []byte("brand new content with no local base to diff against")
+	entry := buildBulkDeltaEntry(t, nil, target)
+
+	header := &tar.Header{Name: "bin/tool", PAXRecords: map[string]string{bulkDeltaPAXRecord: "1"}}
+	if err := c.stageBulkEntry(header, entry, newEmptyReadSeekCloser()); err != nil {
+		t.Fatal("stageBulkEntry failed:", err)
+	}
+
+	staged, err := ioutil.ReadFile(c.staging + "/" + stagedDigest(target))
+	if err != nil {
+		t.Fatal("staged file not found at expected digest path:", err)
+	}
+	if !bytes.Equal(staged, target) {
+		t.Errorf("staged content %q did not match delta target %q", staged, target)
+	}
+}
+
+// TestStageBulkEntryDeltaFromMatchingBase exercises the delta branch when
+// the base matches the target exactly, so the delta consists of operations
+// that copy from base rather than carry the data themselves.
+func TestStageBulkEntryDeltaFromMatchingBase(t *testing.T) {
+	c, staging := newTestBulkClient(t)
+	defer os.RemoveAll(staging)
+
+	content := []byte("unchanged file - base and target are identical")
+	entry := buildBulkDeltaEntry(t, content, content)
+
+	base := &emptyReadSeekCloser{bytes.NewReader(content)}
+	header := &tar.Header{Name: "bin/tool", PAXRecords: map[string]string{bulkDeltaPAXRecord: "1"}}
+	if err := c.stageBulkEntry(header, entry, base); err != nil {
+		t.Fatal("stageBulkEntry failed:", err)
+	}
+
+	staged, err := ioutil.ReadFile(c.staging + "/" + stagedDigest(content))
+	if err != nil {
+		t.Fatal("staged file not found at expected digest path:", err)
+	}
+	if !bytes.Equal(staged, content) {
+		t.Errorf("staged content %q did not match unchanged base %q", staged, content)
+	}
+}
@@ -0,0 +1,208 @@
+package rsync
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// stagingCacheLockName is the name of the advisory lock file created
+	// inside the staging directory to coordinate Rename and Prune operations
+	// across Clients that share it.
+	stagingCacheLockName = ".rsync-staging-lock"
+
+	// stagingCacheLockRetryInterval is the delay between attempts to acquire
+	// the staging directory lock file.
+	stagingCacheLockRetryInterval = 10 * time.Millisecond
+
+	// stagingCacheLockTimeout is the maximum amount of time to wait to
+	// acquire the staging directory lock file before giving up.
+	stagingCacheLockTimeout = 5 * time.Second
+)
+
+// StagingCache wraps a staging directory shared by one or more Clients,
+// governing concurrent access to it and providing reference counting and
+// pruning so that the directory doesn't grow without bound. Entries are
+// named by their content digest, matching the naming scheme that Client
+// already uses when renaming completed files into the staging directory.
+//
+// A StagingCache's in-process state (its reference counts) only coordinates
+// Acquire/Release/Prune calls made through this StagingCache instance; the
+// on-disk lock file additionally coordinates the Rename performed by
+// Client.receive across separate processes sharing the same directory, but
+// it's advisory and has no effect on processes that don't use it.
+type StagingCache struct {
+	root string
+
+	lock      sync.Mutex
+	refCounts map[string]int
+}
+
+// NewStagingCache creates a StagingCache wrapping the given staging
+// directory. The directory must already exist.
+func NewStagingCache(root string) *StagingCache {
+	return &StagingCache{
+		root:      root,
+		refCounts: make(map[string]int),
+	}
+}
+
+// lockPath returns the path of the advisory lock file for this cache's
+// staging directory.
+func (s *StagingCache) lockPath() string {
+	return filepath.Join(s.root, stagingCacheLockName)
+}
+
+// withDirLock acquires the on-disk advisory lock file, runs f, and releases
+// the lock file, giving up with an error if the lock can't be acquired
+// within stagingCacheLockTimeout.
+func (s *StagingCache) withDirLock(f func() error) error {
+	return withFileLock(s.lockPath(), stagingCacheLockTimeout, stagingCacheLockRetryInterval, f)
+}
+
+// withFileLock creates lockPath exclusively as an empty advisory lock file,
+// retrying every retryInterval until it succeeds or timeout elapses, then
+// runs f and removes lockPath once f returns. It's the primitive behind
+// withDirLock above and, with a per-path lock file instead of a
+// directory-wide one, behind checkpoint.go's withPartialLock.
+func withFileLock(lockPath string, timeout, retryInterval time.Duration, f func() error) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		lockFile, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			lockFile.Close()
+			break
+		} else if !os.IsExist(err) {
+			return err
+		} else if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for lock file %s", lockPath)
+		}
+		time.Sleep(retryInterval)
+	}
+	defer os.Remove(lockPath)
+
+	return f()
+}
+
+// Acquire marks digest as in-use, preventing Prune from removing it until
+// the returned release function is called. It may be called multiple times
+// (even concurrently) for the same digest; the entry remains protected until
+// every acquired reference has been released.
+func (s *StagingCache) Acquire(digest string) func() {
+	s.lock.Lock()
+	s.refCounts[digest]++
+	s.lock.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.lock.Lock()
+			defer s.lock.Unlock()
+			if s.refCounts[digest] <= 1 {
+				delete(s.refCounts, digest)
+			} else {
+				s.refCounts[digest]--
+			}
+		})
+	}
+}
+
+// inUse reports whether digest currently has any outstanding references
+// acquired through this StagingCache.
+func (s *StagingCache) inUse(digest string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.refCounts[digest] > 0
+}
+
+// Lookup opens the cached content for digest, if present. Client.receive
+// uses this once it knows the digest of what it just received, to reuse an
+// existing entry instead of renaming its own copy into place.
+//
+// That's the only point at which it's consulted: nothing in the
+// request/response wire format lets the Server announce a path's resulting
+// digest before the delta for it has actually been requested, signed,
+// transferred, and applied, so this only short-circuits the final disk
+// write, not that work. Re-staging identical content - even across
+// Clients sharing this cache - still pays for a full delta round-trip.
+// Avoiding that would require extending the wire format so the Server can
+// advertise its digest up front. The caller is responsible for closing the
+// returned ReadCloser.
+func (s *StagingCache) Lookup(digest string) (io.ReadCloser, bool) {
+	f, err := os.Open(filepath.Join(s.root, digest))
+	if err != nil {
+		return nil, false
+	}
+	return f, true
+}
+
+// Prune removes unreferenced entries from the staging directory, oldest
+// first, until the directory is at most maxBytes in size, and additionally
+// removes any unreferenced entry whose modification time is older than
+// maxAge regardless of the size target. A maxBytes of 0 disables size-based
+// eviction and a maxAge of 0 disables age-based eviction. Entries that are
+// currently Acquired are never removed.
+func (s *StagingCache) Prune(maxBytes int64, maxAge time.Duration) error {
+	return s.withDirLock(func() error {
+		entries, err := ioutil.ReadDir(s.root)
+		if err != nil {
+			return err
+		}
+
+		type candidate struct {
+			name    string
+			size    int64
+			modTime time.Time
+		}
+		var candidates []candidate
+		var total int64
+		for _, entry := range entries {
+			if entry.IsDir() || entry.Name() == stagingCacheLockName {
+				continue
+			}
+			// Partial files, their checkpoint sidecars, and the advisory
+			// locks guarding them aren't cache entries; they belong to a
+			// resumable Stage call that may still be in progress, and are
+			// never Acquired, so they'd otherwise look like prunable LRU
+			// victims.
+			if strings.HasSuffix(entry.Name(), partialSuffix) ||
+				strings.HasSuffix(entry.Name(), checkpointSuffix) ||
+				strings.HasSuffix(entry.Name(), partialLockSuffix) {
+				continue
+			}
+			total += entry.Size()
+			candidates = append(candidates, candidate{entry.Name(), entry.Size(), entry.ModTime()})
+		}
+
+		sort.Slice(candidates, func(i, j int) bool {
+			return candidates[i].modTime.Before(candidates[j].modTime)
+		})
+
+		now := time.Now()
+		for _, c := range candidates {
+			if s.inUse(c.name) {
+				continue
+			}
+
+			expired := maxAge > 0 && now.Sub(c.modTime) > maxAge
+			overBudget := maxBytes > 0 && total > maxBytes
+			if !expired && !overBudget {
+				continue
+			}
+
+			if err := os.Remove(filepath.Join(s.root, c.name)); err != nil {
+				continue
+			}
+			total -= c.size
+		}
+
+		return nil
+	})
+}
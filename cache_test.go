@@ -0,0 +1,131 @@
+package rsync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeStagingEntry(t *testing.T, root, name, content string) {
+	t.Helper()
+	if err := ioutil.WriteFile(filepath.Join(root, name), []byte(content), 0600); err != nil {
+		t.Fatal("couldn't write staging entry:", err)
+	}
+}
+
+func TestStagingCacheAcquireRelease(t *testing.T) {
+	root, err := ioutil.TempDir("", "rsync-cache")
+	if err != nil {
+		t.Fatal("couldn't create temporary staging directory:", err)
+	}
+	defer os.RemoveAll(root)
+
+	cache := NewStagingCache(root)
+
+	if cache.inUse("digest") {
+		t.Fatal("digest reported in-use before being acquired")
+	}
+
+	releaseFirst := cache.Acquire("digest")
+	releaseSecond := cache.Acquire("digest")
+	if !cache.inUse("digest") {
+		t.Fatal("digest not reported in-use after being acquired")
+	}
+
+	releaseFirst()
+	if !cache.inUse("digest") {
+		t.Fatal("digest released while a second reference was still outstanding")
+	}
+
+	releaseSecond()
+	if cache.inUse("digest") {
+		t.Fatal("digest still reported in-use after every reference was released")
+	}
+
+	// Releasing again must not panic or underflow the reference count.
+	releaseSecond()
+	if cache.inUse("digest") {
+		t.Fatal("digest reported in-use after a redundant release")
+	}
+}
+
+func TestStagingCachePruneRespectsInUse(t *testing.T) {
+	root, err := ioutil.TempDir("", "rsync-cache")
+	if err != nil {
+		t.Fatal("couldn't create temporary staging directory:", err)
+	}
+	defer os.RemoveAll(root)
+
+	writeStagingEntry(t, root, "acquired", "content")
+	writeStagingEntry(t, root, "unacquired", "content")
+
+	cache := NewStagingCache(root)
+	release := cache.Acquire("acquired")
+	defer release()
+
+	// A maxBytes of 1 forces Prune to try to evict everything it can.
+	if err := cache.Prune(1, 0); err != nil {
+		t.Fatal("prune failed:", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(root, "acquired")); err != nil {
+		t.Error("prune removed an acquired entry:", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "unacquired")); err == nil {
+		t.Error("prune did not remove an unacquired entry over the size budget")
+	}
+}
+
+func TestStagingCachePruneMaxAge(t *testing.T) {
+	root, err := ioutil.TempDir("", "rsync-cache")
+	if err != nil {
+		t.Fatal("couldn't create temporary staging directory:", err)
+	}
+	defer os.RemoveAll(root)
+
+	writeStagingEntry(t, root, "stale", "content")
+	old := time.Now().Add(-24 * time.Hour)
+	if err := os.Chtimes(filepath.Join(root, "stale"), old, old); err != nil {
+		t.Fatal("couldn't backdate entry modification time:", err)
+	}
+	writeStagingEntry(t, root, "fresh", "content")
+
+	cache := NewStagingCache(root)
+
+	// A maxBytes of 0 disables size-based eviction, so only the stale entry
+	// should go.
+	if err := cache.Prune(0, time.Hour); err != nil {
+		t.Fatal("prune failed:", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(root, "stale")); err == nil {
+		t.Error("prune did not remove an entry older than maxAge")
+	}
+	if _, err := os.Stat(filepath.Join(root, "fresh")); err != nil {
+		t.Error("prune removed an entry younger than maxAge:", err)
+	}
+}
+
+func TestStagingCacheLookup(t *testing.T) {
+	root, err := ioutil.TempDir("", "rsync-cache")
+	if err != nil {
+		t.Fatal("couldn't create temporary staging directory:", err)
+	}
+	defer os.RemoveAll(root)
+
+	writeStagingEntry(t, root, "digest", "content")
+
+	cache := NewStagingCache(root)
+
+	reader, ok := cache.Lookup("digest")
+	if !ok {
+		t.Fatal("lookup failed to find an existing entry")
+	}
+	reader.Close()
+
+	if _, ok := cache.Lookup("missing"); ok {
+		t.Error("lookup found an entry that doesn't exist")
+	}
+}
@@ -0,0 +1,182 @@
+package rsync
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// checkpointOperationInterval is how many rsync.Operation values receive
+	// applies to a file between writes of a resumability checkpoint for it.
+	checkpointOperationInterval = 64
+
+	// defaultMaxResumeAge is the MaxResumeAge StageOptions uses when it's
+	// left unset, discarding checkpoints older than this rather than
+	// resuming from them indefinitely.
+	defaultMaxResumeAge = 24 * time.Hour
+
+	// checkpointSuffix names the sidecar file receive writes alongside a
+	// partially-staged file, recording how much of it has been applied so
+	// that a later Stage call can resume it.
+	checkpointSuffix = ".rsync-checkpoint"
+
+	// partialSuffix names the file receive writes a file's content into
+	// while staging it. It's kept, rather than removed, for as long as a
+	// checkpoint sidecar exists alongside it.
+	partialSuffix = ".rsync-partial"
+
+	// partialLockSuffix names the advisory lock file guarding a path's
+	// partial file and checkpoint sidecar against concurrent access, since
+	// checkpointBaseName is deterministic and two Stage calls for the same
+	// Path (from the same Client run concurrently, or from two Clients
+	// sharing a staging directory) would otherwise open, seek, and write
+	// the same partial file with no coordination at all.
+	partialLockSuffix = ".rsync-partial-lock"
+
+	// partialLockRetryInterval is the delay between attempts to acquire a
+	// path's partial file lock.
+	partialLockRetryInterval = 10 * time.Millisecond
+
+	// partialLockTimeout is the maximum amount of time to wait to acquire a
+	// path's partial file lock before giving up. It's longer than
+	// stagingCacheLockTimeout because, unlike the staging directory lock
+	// (held only for the length of a rename), this lock is held for as
+	// long as an entire file's staging takes.
+	partialLockTimeout = 5 * time.Minute
+)
+
+// checkpoint records how far receive got applying operations to a path
+// before the connection was lost, so that a later Client.Stage call can
+// resume it instead of restarting from scratch.
+type checkpoint struct {
+	Path   Path
+	Offset int64
+	Digest string // hex digest of the first Offset bytes applied so far
+}
+
+// checkpointBaseName derives a filesystem-safe, deterministic name for
+// path's partial file and checkpoint sidecar, so that a later process can
+// find them without having kept anything else in memory. It hashes path's
+// components (rather than, say, joining them with "_") so that distinct
+// paths can't collide onto the same name, which a naive join could do (e.g.
+// Path{"bin_dir", "tool"} and Path{"bin", "dir_tool"}).
+func checkpointBaseName(path Path) string {
+	hasher := sha256.New()
+	for _, component := range path {
+		io.WriteString(hasher, component)
+		hasher.Write([]byte{0})
+	}
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+func partialPath(staging string, path Path) string {
+	return filepath.Join(staging, checkpointBaseName(path)+partialSuffix)
+}
+
+func checkpointPath(staging string, path Path) string {
+	return filepath.Join(staging, checkpointBaseName(path)+checkpointSuffix)
+}
+
+func partialLockPath(staging string, path Path) string {
+	return filepath.Join(staging, checkpointBaseName(path)+partialLockSuffix)
+}
+
+// withPartialLock serializes access to path's partial file and checkpoint
+// sidecar, from opening it through writing (or discarding) its final
+// checkpoint, across every Client staging it concurrently, so that two
+// callers can't corrupt each other's writes to the same deterministic
+// partial file.
+func withPartialLock(staging string, path Path, f func() error) error {
+	return withFileLock(partialLockPath(staging, path), partialLockTimeout, partialLockRetryInterval, f)
+}
+
+// writeCheckpoint persists cp as the sidecar for its path, overwriting any
+// previous checkpoint for the same path.
+func writeCheckpoint(staging string, cp checkpoint) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(checkpointPath(staging, cp.Path), data, 0600)
+}
+
+// removeCheckpoint discards path's checkpoint sidecar and partial file, if
+// any, used once a file has staged successfully or its checkpoint has been
+// deemed unusable.
+func removeCheckpoint(staging string, path Path) {
+	os.Remove(checkpointPath(staging, path))
+	os.Remove(partialPath(staging, path))
+}
+
+// verifyCheckpoint reports whether cp's partial file still exists and
+// hashing its first cp.Offset bytes with hashConstructor reproduces
+// cp.Digest.
+func verifyCheckpoint(staging string, hashConstructor HashConstructor, cp checkpoint) bool {
+	partial, err := os.Open(partialPath(staging, cp.Path))
+	if err != nil {
+		return false
+	}
+	defer partial.Close()
+
+	hasher := hashConstructor()
+	if _, err := io.Copy(hasher, io.NewSectionReader(partial, 0, cp.Offset)); err != nil {
+		return false
+	}
+	return fmt.Sprintf("%x", hasher.Sum(nil)) == cp.Digest
+}
+
+// scanCheckpoints reads every checkpoint sidecar in staging, keyed by its
+// path's string form, discarding (and cleaning up) any that's older than
+// maxAge or that doesn't verify against its partial file. A maxAge of 0
+// disables the age check.
+func scanCheckpoints(staging string, hashConstructor HashConstructor, maxAge time.Duration) (map[string]checkpoint, error) {
+	entries, err := ioutil.ReadDir(staging)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]checkpoint)
+	now := time.Now()
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), checkpointSuffix) {
+			continue
+		}
+
+		sidecarPath := filepath.Join(staging, entry.Name())
+		partialFilePath := filepath.Join(staging, strings.TrimSuffix(entry.Name(), checkpointSuffix)+partialSuffix)
+		if maxAge > 0 && now.Sub(entry.ModTime()) > maxAge {
+			os.Remove(sidecarPath)
+			os.Remove(partialFilePath)
+			continue
+		}
+
+		data, err := ioutil.ReadFile(sidecarPath)
+		if err != nil {
+			continue
+		}
+		var cp checkpoint
+		if err := json.Unmarshal(data, &cp); err != nil {
+			os.Remove(sidecarPath)
+			os.Remove(partialFilePath)
+			continue
+		}
+
+		if !verifyCheckpoint(staging, hashConstructor, cp) {
+			os.Remove(sidecarPath)
+			os.Remove(partialPath(staging, cp.Path))
+			continue
+		}
+
+		result[cp.Path.String()] = cp
+	}
+
+	return result, nil
+}
@@ -0,0 +1,141 @@
+package rsync
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCheckpointBaseNameAvoidsCollisions(t *testing.T) {
+	first := checkpointBaseName(Path{"bin_dir", "tool"})
+	second := checkpointBaseName(Path{"bin", "dir_tool"})
+	if first == second {
+		t.Fatal("distinct paths produced the same checkpoint base name")
+	}
+}
+
+func TestWriteVerifyAndScanCheckpoint(t *testing.T) {
+	staging, err := ioutil.TempDir("", "rsync-checkpoint")
+	if err != nil {
+		t.Fatal("couldn't create temporary staging directory:", err)
+	}
+	defer os.RemoveAll(staging)
+
+	path := Path{"some", "file"}
+	content := []byte("hello, resumable world")
+	if err := ioutil.WriteFile(partialPath(staging, path), content, 0600); err != nil {
+		t.Fatal("couldn't write partial file:", err)
+	}
+
+	hasher := sha256.New()
+	hasher.Write(content)
+	cp := checkpoint{Path: path, Offset: int64(len(content)), Digest: fmt.Sprintf("%x", hasher.Sum(nil))}
+
+	if err := writeCheckpoint(staging, cp); err != nil {
+		t.Fatal("couldn't write checkpoint:", err)
+	}
+
+	if !verifyCheckpoint(staging, sha256.New, cp) {
+		t.Fatal("verifyCheckpoint rejected a checkpoint matching its partial file")
+	}
+
+	checkpoints, err := scanCheckpoints(staging, sha256.New, 0)
+	if err != nil {
+		t.Fatal("scanCheckpoints failed:", err)
+	}
+	found, ok := checkpoints[path.String()]
+	if !ok {
+		t.Fatal("scanCheckpoints did not return the checkpoint that was written")
+	}
+	if found.Offset != cp.Offset || found.Digest != cp.Digest {
+		t.Errorf("scanned checkpoint %+v did not match written checkpoint %+v", found, cp)
+	}
+
+	removeCheckpoint(staging, path)
+	if _, err := os.Stat(checkpointPath(staging, path)); err == nil {
+		t.Error("removeCheckpoint left the checkpoint sidecar in place")
+	}
+	if _, err := os.Stat(partialPath(staging, path)); err == nil {
+		t.Error("removeCheckpoint left the partial file in place")
+	}
+}
+
+func TestVerifyCheckpointRejectsTamperedPartial(t *testing.T) {
+	staging, err := ioutil.TempDir("", "rsync-checkpoint")
+	if err != nil {
+		t.Fatal("couldn't create temporary staging directory:", err)
+	}
+	defer os.RemoveAll(staging)
+
+	path := Path{"some", "file"}
+	if err := ioutil.WriteFile(partialPath(staging, path), []byte("original content"), 0600); err != nil {
+		t.Fatal("couldn't write partial file:", err)
+	}
+
+	hasher := sha256.New()
+	hasher.Write([]byte("original content"))
+	cp := checkpoint{Path: path, Offset: int64(len("original content")), Digest: fmt.Sprintf("%x", hasher.Sum(nil))}
+
+	// Truncate and rewrite the partial file with different content of the
+	// same length, so the checkpoint's recorded offset still fits but the
+	// bytes it covers no longer hash to the recorded digest.
+	if err := ioutil.WriteFile(partialPath(staging, path), []byte("tampered content"), 0600); err != nil {
+		t.Fatal("couldn't rewrite partial file:", err)
+	}
+
+	if verifyCheckpoint(staging, sha256.New, cp) {
+		t.Fatal("verifyCheckpoint accepted a checkpoint whose partial file was tampered with")
+	}
+}
+
+func TestScanCheckpointsDiscardsExpired(t *testing.T) {
+	staging, err := ioutil.TempDir("", "rsync-checkpoint")
+	if err != nil {
+		t.Fatal("couldn't create temporary staging directory:", err)
+	}
+	defer os.RemoveAll(staging)
+
+	path := Path{"stale", "file"}
+	if err := ioutil.WriteFile(partialPath(staging, path), []byte("content"), 0600); err != nil {
+		t.Fatal("couldn't write partial file:", err)
+	}
+
+	hasher := sha256.New()
+	hasher.Write([]byte("content"))
+	cp := checkpoint{Path: path, Offset: int64(len("content")), Digest: fmt.Sprintf("%x", hasher.Sum(nil))}
+	if err := writeCheckpoint(staging, cp); err != nil {
+		t.Fatal("couldn't write checkpoint:", err)
+	}
+
+	old := time.Now().Add(-48 * time.Hour)
+	sidecar := checkpointPath(staging, path)
+	if err := os.Chtimes(sidecar, old, old); err != nil {
+		t.Fatal("couldn't backdate checkpoint modification time:", err)
+	}
+
+	checkpoints, err := scanCheckpoints(staging, sha256.New, 24*time.Hour)
+	if err != nil {
+		t.Fatal("scanCheckpoints failed:", err)
+	}
+	if _, ok := checkpoints[path.String()]; ok {
+		t.Error("scanCheckpoints returned a checkpoint older than maxAge")
+	}
+	if _, err := os.Stat(sidecar); err == nil {
+		t.Error("scanCheckpoints did not clean up the expired checkpoint sidecar")
+	}
+}
+
+func TestCheckpointPathsStayWithinStaging(t *testing.T) {
+	staging := "/staging/root"
+	path := Path{"a", "b"}
+	if dir := filepath.Dir(partialPath(staging, path)); dir != staging {
+		t.Errorf("expected partial file to live directly in %q, got %q", staging, dir)
+	}
+	if dir := filepath.Dir(checkpointPath(staging, path)); dir != staging {
+		t.Errorf("expected checkpoint sidecar to live directly in %q, got %q", staging, dir)
+	}
+}
@@ -2,12 +2,14 @@ package rsync
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"hash"
 	"io"
-	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync/atomic"
+	"time"
 
 	"bitbucket.org/kardianos/rsync"
 )
@@ -36,8 +38,44 @@ func (e *emptyReadSeekCloser) Close() error {
 }
 
 type dispatchedRequest struct {
-	path Path
-	base readSeekCloser
+	path         Path
+	base         readSeekCloser
+	size         int64
+	resumeOffset int64
+}
+
+// ProgressCallback is invoked during Stage as operations are applied while
+// receiving a file, reporting cumulative bytes transferred for that file
+// against the size of its base (used as an estimate of the total transfer
+// size) and the number of rsync.Operation values consumed so far.
+type ProgressCallback func(path Path, bytesTransferred, totalBytes int64, operations int)
+
+// StageOptions controls the behavior of Client.Stage.
+type StageOptions struct {
+	// Progress, if non-nil, is invoked as each file is staged. It may be
+	// called concurrently with itself for different files and should not
+	// block for any significant length of time.
+	Progress ProgressCallback
+
+	// MaxResumeAge bounds how old a checkpoint left by a previous, aborted
+	// Stage call may be for this call to resume it; older checkpoints are
+	// discarded and staged from scratch instead. If zero,
+	// defaultMaxResumeAge is used.
+	MaxResumeAge time.Duration
+}
+
+// countingWriter wraps an io.Writer, atomically accumulating the number of
+// bytes written to it so that it can be read concurrently for progress
+// reporting.
+type countingWriter struct {
+	io.Writer
+	written *int64
+}
+
+func (w countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	atomic.AddInt64(w.written, int64(n))
+	return n, err
 }
 
 type Client struct {
@@ -47,22 +85,99 @@ type Client struct {
 	dispatchRsyncer *rsync.RSync
 	receiveRsyncer  *rsync.RSync
 	stagingHash     hash.Hash
+	hashConstructor HashConstructor
+	cache           *StagingCache
+
+	// bulkDispatchRsyncer, bulkReceiveRsyncer, and bulkStagingHash mirror
+	// dispatchRsyncer, receiveRsyncer, and stagingHash above, but are used
+	// by StageBulk instead of Stage. A single rsync.RSync (per its own doc
+	// comment) and hash.Hash must not be used concurrently, and Stage and
+	// StageBulk are each single-threaded pipelines over their own fields,
+	// so without separate instances a Stage call and a StageBulk call
+	// running at the same time on one Client would race on the same
+	// hasher. See the restriction on Stage's and StageBulk's doc comments
+	// for what's still not safe even with separate instances.
+	bulkDispatchRsyncer *rsync.RSync
+	bulkReceiveRsyncer  *rsync.RSync
+	bulkStagingHash     hash.Hash
 }
 
-func NewClient(root, staging string, stagingHash hash.Hash, connection io.ReadWriteCloser) *Client {
-	return &Client{
-		root:            root,
-		staging:         staging,
-		stagingHash:     stagingHash,
-		stream:          newStream(connection),
-		dispatchRsyncer: newRsyncer(),
-		receiveRsyncer:  newRsyncer(),
+// NewClient connects to a Server over connection, negotiating the hash
+// algorithm used for both rsync block hashes and staging content addresses,
+// as well as the compression scheme used to frame traffic for the
+// remainder of the connection. preferredHashes lists the hash algorithms
+// this Client supports, in order of preference; if nil, defaultHashPreference
+// is used. It's a terminal error if the Server doesn't support any hash or
+// compression scheme in common with this Client. streamOptions, if given,
+// are applied to the underlying Stream (e.g. WithMaxMessageSize,
+// WithMetrics); any WithCompression among them is ignored, since the
+// handshake always negotiates the compression scheme itself.
+func NewClient(root, staging string, connection io.ReadWriteCloser, preferredHashes []string, streamOptions ...StreamOption) (*Client, error) {
+	if len(preferredHashes) == 0 {
+		preferredHashes = defaultHashPreference
+	}
+
+	stream := newStream(connection, streamOptions...)
+
+	// The handshake itself must always be exchanged uncompressed, since
+	// neither side has agreed on a scheme yet, so force "none" here
+	// regardless of whether streamOptions included a WithCompression of its
+	// own; the negotiated scheme below overrides this once it's known.
+	stream.setCompressor(noneCompressor{})
+
+	// Perform the hash and compression handshake before any request is
+	// sent. The corresponding server-side logic reads handshakeRequest,
+	// selects the strongest mutually supported hash via strongestSupported
+	// and compression scheme via strongestSupportedCompressor, and replies
+	// with handshakeResponse.
+	request := handshakeRequest{preferredHashes, defaultCompressionPreference}
+	if err := stream.Encode(request); err != nil {
+		return nil, err
 	}
+	var response handshakeResponse
+	if err := stream.Decode(&response); err != nil {
+		return nil, err
+	}
+	constructor, ok := hashConstructors[response.SelectedHash]
+	if !ok {
+		return nil, fmt.Errorf("server selected unsupported hash algorithm %q", response.SelectedHash)
+	}
+	compressor, ok := compressors[response.SelectedCompressor]
+	if !ok {
+		return nil, fmt.Errorf("server selected unsupported compression scheme %q", response.SelectedCompressor)
+	}
+	stream.setCompressor(compressor)
+
+	return &Client{
+		root:                root,
+		staging:             staging,
+		stagingHash:         constructor(),
+		hashConstructor:     constructor,
+		stream:              stream,
+		dispatchRsyncer:     newRsyncer(constructor),
+		receiveRsyncer:      newRsyncer(constructor),
+		cache:               NewStagingCache(staging),
+		bulkDispatchRsyncer: newRsyncer(constructor),
+		bulkReceiveRsyncer:  newRsyncer(constructor),
+		bulkStagingHash:     constructor(),
+	}, nil
 }
 
-func (c *Client) dispatch(paths []Path, outstanding chan<- dispatchedRequest, cancel <-chan struct{}) error {
+// Cache returns the StagingCache backing this Client's staging directory, so
+// that callers can Prune it (e.g. on a timer) or Acquire digests they need
+// to protect from pruning while using them outside of Stage.
+func (c *Client) Cache() *StagingCache {
+	return c.cache
+}
+
+func (c *Client) dispatch(paths []Path, resumable map[string]checkpoint, outstanding chan<- dispatchedRequest, cancel <-chan struct{}) error {
 	// Loop over paths and dispatch.
+dispatchLoop:
 	for _, path := range paths {
+		// See if a checkpoint from a previous, aborted Stage call lets us
+		// resume this path instead of staging it from scratch.
+		resume := resumable[path.String()]
+
 		// Open the base. If this fails (which it might if the file doesn't
 		// exist), then simply use an empty base.
 		var base readSeekCloser
@@ -72,6 +187,15 @@ func (c *Client) dispatch(paths []Path, outstanding chan<- dispatchedRequest, ca
 			base = f
 		}
 
+		// Compute the base size for progress reporting purposes. If this
+		// fails, just treat the size as unknown (0) rather than treating it
+		// as terminal, since it's only used to give callers a sense of scale.
+		var size int64
+		if end, err := base.Seek(0, io.SeekEnd); err == nil {
+			size = end
+			base.Seek(0, io.SeekStart)
+		}
+
 		// Compute the base signature. If there is an error, just abort, because
 		// most likely the file is being modified concurrently and we'll have to
 		// stage again later. We don't treat this as terminal though.
@@ -86,16 +210,19 @@ func (c *Client) dispatch(paths []Path, outstanding chan<- dispatchedRequest, ca
 		}
 
 		// Send the request.
-		if err := c.stream.Encode(request{path, signature}); err != nil {
+		if err := c.stream.Encode(request{path, signature, resume.Offset, resume.Digest}); err != nil {
 			return err
 		}
 
-		// Send the request to the receiver, but watch for cancellation.
+		// Send the request to the receiver, but watch for cancellation. A
+		// plain break here would only exit the select, not this loop, so
+		// cancellation wouldn't actually stop dispatch from opening and
+		// signing every remaining path; break the labeled loop instead.
 		select {
-		case outstanding <- dispatchedRequest{path, base}:
+		case outstanding <- dispatchedRequest{path, base, size, resume.Offset}:
 		case <-cancel:
 			base.Close()
-			break
+			break dispatchLoop
 		}
 	}
 
@@ -106,6 +233,15 @@ func (c *Client) dispatch(paths []Path, outstanding chan<- dispatchedRequest, ca
 	return nil
 }
 
+// burnRemainingOperations discards operations for the file currently being
+// received after a local error, so that the stream is left positioned at
+// the next request's response rather than desynchronized mid-file.
+//
+// TODO: This still gob-decodes every remaining response rather than
+// skipping at the frameConn level. Doing the latter would make this
+// trivially cheap, but requires knowing a response's frame boundary before
+// decoding it, which isn't exposed by the gob.Decoder API Stream is built
+// on.
 func (c *Client) burnRemainingOperations() error {
 	for {
 		var response response
@@ -117,7 +253,27 @@ func (c *Client) burnRemainingOperations() error {
 	}
 }
 
-func (c *Client) receive(outstanding <-chan dispatchedRequest, cancel <-chan struct{}) error {
+// writeReceiveCheckpoint persists a resumability checkpoint for the file
+// currently being received, recording offset (dispatchedRequest.resumeOffset
+// plus the bytes written so far this Stage call) and a digest of target's
+// first offset bytes computed independently of c.stagingHash, which may be
+// concurrently updated by the ApplyDelta Goroutine. Failures are not
+// terminal; they just mean this path won't be resumable if the connection
+// is subsequently lost.
+func (c *Client) writeReceiveCheckpoint(dispatchedRequest dispatchedRequest, target *os.File, written int64) {
+	offset := dispatchedRequest.resumeOffset + written
+	hasher := c.hashConstructor()
+	if _, err := io.Copy(hasher, io.NewSectionReader(target, 0, offset)); err != nil {
+		return
+	}
+	writeCheckpoint(c.staging, checkpoint{
+		Path:   dispatchedRequest.path,
+		Offset: offset,
+		Digest: fmt.Sprintf("%x", hasher.Sum(nil)),
+	})
+}
+
+func (c *Client) receive(outstanding <-chan dispatchedRequest, cancel <-chan struct{}, progress ProgressCallback) error {
 	// Loop until we've processed all outstanding requests or been cancelled.
 	for {
 		// Grab the next request, watching for closure of outstanding or
@@ -132,102 +288,204 @@ func (c *Client) receive(outstanding <-chan dispatchedRequest, cancel <-chan str
 			return nil
 		}
 
-		// TODO: Perform a staging update.
-
-		// Create a temporary file to record the output. If we can't open
-		// temporary files, that's a terminal error.
-		target, err := ioutil.TempFile(c.staging, stagingTempFileBaseName)
-		if err != nil {
-			dispatchedRequest.base.Close()
+		// Serialize the whole receive of this path, from opening its
+		// deterministic partial file through writing or discarding its
+		// final checkpoint, against any other Client (including another
+		// Stage call on this same Client run concurrently) staging the
+		// same Path against this staging directory; otherwise two callers
+		// could open, seek, and write the same partial file with no
+		// coordination at all.
+		if err := withPartialLock(c.staging, dispatchedRequest.path, func() error {
+			return c.receiveOne(dispatchedRequest, progress)
+		}); err != nil {
 			return err
 		}
+	}
 
-		// Create channels to communicate with the ApplyDelta Goroutine.
-		operations := make(chan rsync.Operation)
-		applyErrors := make(chan error, 1)
-
-		// Reset the hash state.
-		c.stagingHash.Reset()
-
-		// Start the ApplyDelta operation in a separate Goroutine, recording the
-		// hash of the received contents.
-		go func() {
-			applyErrors <- c.receiveRsyncer.ApplyDelta(
-				target,
-				dispatchedRequest.base,
-				operations,
-				c.stagingHash,
-			)
-		}()
-
-		// Read and feed operations into the Goroutine, watching for errors.
-		var applyError, decodeError error
-		applyExited := false
-		for {
-			// Grab the next operation.
-			var response response
-			if err = c.stream.Decode(&response); err != nil {
-				decodeError = err
-				break
-			}
+	// Unreachable.
+	panic("unreachable")
+}
 
-			// Check if the operation stream is done.
-			if response.Done {
-				break
-			}
+// receiveOne receives and stages a single dispatched request, returning a
+// non-nil error only when receive as a whole should stop; a per-file error
+// that's recorded as a resumable checkpoint (or simply discarded) is not
+// itself a reason to give up on the rest of outstanding, so it's swallowed
+// here rather than returned. The caller is responsible for serializing
+// calls to this method (across Clients, if they share a staging directory)
+// for a given dispatchedRequest.path.
+func (c *Client) receiveOne(dispatchedRequest dispatchedRequest, progress ProgressCallback) error {
+	// TODO: c.cache.Lookup is only consulted below, once the digest is
+	// already known; see its doc comment for why that's a real limitation
+	// and what fixing it would require.
+
+	// Open (or reopen, if resuming) the deterministic partial file for
+	// this path, rather than a randomly-named temporary file, so that a
+	// checkpoint written partway through staging it can be found and
+	// resumed by a later Stage call. If we can't open it, that's a
+	// terminal error.
+	target, err := os.OpenFile(partialPath(c.staging, dispatchedRequest.path), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		dispatchedRequest.base.Close()
+		return err
+	}
 
-			// Forward the operation. If there is an error, burn the remaining
-			// operations in this stream.
-			select {
-			case operations <- response.Operation:
-			case applyError = <-applyErrors:
-				applyExited = true
-				decodeError = c.burnRemainingOperations()
-				break
-			}
+	// Reset the hash state, then, if resuming, prime it with the bytes
+	// already applied and seek past them. If those bytes can't be read
+	// back, fall back to staging this path from scratch. They aren't
+	// compared against the checkpoint's digest here; scanCheckpoints did
+	// that when it loaded the checkpoint.
+	c.stagingHash.Reset()
+	if dispatchedRequest.resumeOffset > 0 {
+		prefix := io.NewSectionReader(target, 0, dispatchedRequest.resumeOffset)
+		if _, err := io.Copy(c.stagingHash, prefix); err != nil {
+			dispatchedRequest.resumeOffset = 0
+			c.stagingHash.Reset()
+			target.Truncate(0)
+		}
+	}
+	target.Seek(dispatchedRequest.resumeOffset, io.SeekStart)
+
+	// Create channels to communicate with the ApplyDelta Goroutine.
+	operations := make(chan rsync.Operation)
+	applyErrors := make(chan error, 1)
+
+	// Track bytes written to the target so that progress can be reported
+	// without needing to inspect individual rsync.Operation values, and so
+	// that checkpoints can record how far we've gotten.
+	var written int64
+	output := io.Writer(countingWriter{target, &written})
+
+	// Start the ApplyDelta operation in a separate Goroutine, recording the
+	// hash of the received contents.
+	go func() {
+		applyErrors <- c.receiveRsyncer.ApplyDelta(
+			output,
+			dispatchedRequest.base,
+			operations,
+			c.stagingHash,
+		)
+	}()
+
+	// Read and feed operations into the Goroutine, watching for errors.
+	var applyError, decodeError error
+	applyExited := false
+	operationCount := 0
+receiveLoop:
+	for {
+		// Grab the next operation.
+		var response response
+		if err = c.stream.Decode(&response); err != nil {
+			decodeError = err
+			break
 		}
 
-		// Tell the ApplyDelta Goroutine that operations are complete. It may
-		// have exited already if there was an error, in which case this will
-		// have no effect.
-		close(operations)
-
-		// Ensure that the Goroutine has completed. We use a separate boolean to
-		// track whether or not applyError was actually set, because it's a bit
-		// more robust than simply checking for a nil error. This is probably
-		// overkill, because ApplyDelta won't return a nil error before
-		// operations is closed, and therefore a nil applyError wouldn't be set
-		// by the loop above, so we could probably just check if applyError is
-		// nil here, but that behavior is not guaranteed in the rsync
-		// documentation, so it's easier to just check explicitly whether or not
-		// it has been set.
-		if !applyExited {
-			applyError = <-applyErrors
+		// Check if the operation stream is done.
+		if response.Done {
+			break
 		}
 
-		// Close the target.
-		target.Close()
+		// Forward the operation. If there is an error, burn the remaining
+		// operations in this stream.
+		select {
+		case operations <- response.Operation:
+			operationCount++
+			if progress != nil {
+				progress(
+					dispatchedRequest.path,
+					atomic.LoadInt64(&written),
+					dispatchedRequest.size,
+					operationCount,
+				)
+			}
+			if operationCount%checkpointOperationInterval == 0 {
+				c.writeReceiveCheckpoint(dispatchedRequest, target, atomic.LoadInt64(&written))
+			}
+		case applyError = <-applyErrors:
+			applyExited = true
+			decodeError = c.burnRemainingOperations()
+			break receiveLoop
+		}
+	}
+
+	// Tell the ApplyDelta Goroutine that operations are complete. It may
+	// have exited already if there was an error, in which case this will
+	// have no effect.
+	close(operations)
+
+	// Ensure that the Goroutine has completed. We use a separate boolean to
+	// track whether or not applyError was actually set, because it's a bit
+	// more robust than simply checking for a nil error. This is probably
+	// overkill, because ApplyDelta won't return a nil error before
+	// operations is closed, and therefore a nil applyError wouldn't be set
+	// by the loop above, so we could probably just check if applyError is
+	// nil here, but that behavior is not guaranteed in the rsync
+	// documentation, so it's easier to just check explicitly whether or not
+	// it has been set.
+	if !applyExited {
+		applyError = <-applyErrors
+	}
+
+	// Close the target.
+	target.Close()
 
-		// If there was an error from any source, simply remove the file,
-		// otherwise stage it.
-		if decodeError != nil || applyError != nil {
+	// If there was an error from any source, remove the file unless a
+	// checkpoint was written for it, in which case leave both in place so
+	// a later Stage call can resume it. Otherwise stage it.
+	if decodeError != nil || applyError != nil {
+		if _, err := os.Stat(checkpointPath(c.staging, dispatchedRequest.path)); err != nil {
 			os.Remove(target.Name())
-		} else {
-			name := fmt.Sprintf("%x", c.stagingHash.Sum(nil))
-			os.Rename(target.Name(), filepath.Join(c.staging, name))
 		}
-
-		// If there was a decode error, then we're toast.
-		if decodeError != nil {
-			return decodeError
+	} else {
+		name := fmt.Sprintf("%x", c.stagingHash.Sum(nil))
+		if stageErr := c.cache.withDirLock(func() error {
+			// If this content is already in the cache (staged previously,
+			// or by another Client sharing this directory), there's
+			// nothing left to do.
+			if cached, ok := c.cache.Lookup(name); ok {
+				cached.Close()
+				os.Remove(target.Name())
+				return nil
+			}
+			return os.Rename(target.Name(), filepath.Join(c.staging, name))
+		}); stageErr != nil {
+			return stageErr
 		}
+		// Only remove the checkpoint once the content has safely landed
+		// under its digest (or matched something already there); removing
+		// it first, as partialPath(...) is exactly target.Name(), would
+		// make the rename above fail every time.
+		removeCheckpoint(c.staging, dispatchedRequest.path)
 	}
 
-	// Unreachable.
-	panic("unreachable")
+	return decodeError
 }
 
-func (c *Client) Stage(paths []Path) error {
+// Stage synchronizes paths against their counterparts on the Server, via
+// rsync deltas against each path's existing copy under root, resuming any
+// checkpoint left by a previous, aborted Stage call where possible.
+//
+// A Client may only have one Stage or StageBulk call running at a time.
+// dispatchRsyncer, receiveRsyncer, and stagingHash (or their StageBulk
+// counterparts) are reused across every path in a single call without
+// synchronization, so calling either of them twice concurrently on the same
+// Client races on those fields. A Stage call and a StageBulk call use
+// separate fields, but both read and write the Client's single Stream, and
+// nothing in its messages tells one call's responses from the other's. Multiple Clients may still Stage against the same staging
+// directory concurrently; that's what StagingCache's locking protects.
+//
+// Note also that Stage doesn't yet avoid paying for a full delta transfer
+// when the resulting content turns out to already be cached; see
+// StagingCache.Lookup's doc comment for why.
+func (c *Client) Stage(ctx context.Context, paths []Path, options StageOptions) error {
+	// See what, if anything, is resumable from a previous, aborted Stage
+	// call. Failure to scan isn't terminal; it just means nothing resumes
+	// and every path is staged from scratch, as if staging fresh.
+	maxResumeAge := options.MaxResumeAge
+	if maxResumeAge == 0 {
+		maxResumeAge = defaultMaxResumeAge
+	}
+	resumable, _ := scanCheckpoints(c.staging, c.hashConstructor, maxResumeAge)
+
 	// Create pipeline channels.
 	outstanding := make(chan dispatchedRequest, maxOutstandingStagingRequests)
 	dispatchErrors := make(chan error)
@@ -237,10 +495,31 @@ func (c *Client) Stage(paths []Path) error {
 
 	// Start the pipeline.
 	go func() {
-		dispatchErrors <- c.dispatch(paths, outstanding, dispatchCancel)
+		dispatchErrors <- c.dispatch(paths, resumable, outstanding, dispatchCancel)
 	}()
 	go func() {
-		receiveErrors <- c.receive(outstanding, receiveCancel)
+		receiveErrors <- c.receive(outstanding, receiveCancel, options.Progress)
+	}()
+
+	// Watch for cancellation via the context. If it's cancelled before the
+	// pipeline finishes on its own, cancel both halves and close the
+	// underlying stream so that any Goroutine blocked on it unblocks.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			select {
+			case dispatchCancel <- struct{}{}:
+			default:
+			}
+			select {
+			case receiveCancel <- struct{}{}:
+			default:
+			}
+			c.stream.Close()
+		case <-done:
+		}
 	}()
 
 	// Wait for both Goroutines to exit. If there is an error, then cancel,
@@ -274,6 +553,8 @@ func (c *Client) Stage(paths []Path) error {
 		return dispatchError
 	} else if receiveError != nil {
 		return receiveError
+	} else if ctx.Err() != nil {
+		return ctx.Err()
 	}
 
 	// Success.
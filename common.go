@@ -2,17 +2,80 @@ package rsync
 
 import (
 	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"hash"
 
 	"bitbucket.org/kardianos/rsync"
 )
 
-func newRsyncer() *rsync.RSync {
-	return &rsync.RSync{UniqueHasher: sha1.New()}
+// HashConstructor creates a new hash.Hash for a particular algorithm.
+type HashConstructor func() hash.Hash
+
+// hashConstructors is the registry of hash algorithms that a Client and
+// Server can negotiate, keyed by the short name sent across the wire during
+// the handshake. Registering a new entry is sufficient to make it
+// negotiable without touching the handshake logic itself.
+var hashConstructors = map[string]HashConstructor{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+// defaultHashPreference is the order in which a Client advertises its
+// supported algorithms when none are specified explicitly, strongest first.
+var defaultHashPreference = []string{"sha256", "sha1"}
+
+// RegisterHash makes an additional hash algorithm (e.g. blake3, via a
+// third-party package) available for negotiation under the given name.
+func RegisterHash(name string, constructor HashConstructor) {
+	hashConstructors[name] = constructor
+}
+
+// strongestSupported returns the first algorithm in preferred that's present
+// in hashConstructors, used by the server side of the handshake to pick a
+// mutually supported algorithm from a client's preference list.
+func strongestSupported(preferred []string) (string, HashConstructor, error) {
+	for _, name := range preferred {
+		if constructor, ok := hashConstructors[name]; ok {
+			return name, constructor, nil
+		}
+	}
+	return "", nil, fmt.Errorf("no mutually supported hash algorithm")
+}
+
+func newRsyncer(hasher HashConstructor) *rsync.RSync {
+	return &rsync.RSync{UniqueHasher: hasher()}
+}
+
+// handshakeRequest is the first message a Client sends on a Stream, before
+// any request, advertising the hash algorithms and compression schemes it
+// supports, in order of preference. It's always sent uncompressed, since no
+// compression scheme has been agreed on yet.
+type handshakeRequest struct {
+	SupportedHashes      []string
+	SupportedCompressors []string
+}
+
+// handshakeResponse is the Server's reply to a handshakeRequest, naming the
+// hash algorithm and compression scheme it selected. The hash is used for
+// both rsync block hashes and staging content addresses, and the
+// compression scheme for all frames, for the remainder of the connection.
+type handshakeResponse struct {
+	SelectedHash       string
+	SelectedCompressor string
 }
 
+// request asks the Server to compute (and stream as a sequence of
+// response values) a delta for Path against BaseSignature. If ResumeOffset
+// is non-zero, the client has already applied the first ResumeOffset bytes
+// of a prior delta for this path (verified against ResumeDigest) and is
+// asking the server to resume operation emission from that point rather
+// than recompute the whole delta.
 type request struct {
 	Path          Path
 	BaseSignature []rsync.BlockHash
+	ResumeOffset  int64
+	ResumeDigest  string
 }
 
 type response struct {
@@ -0,0 +1,40 @@
+package rsync
+
+import (
+	"crypto/md5"
+	"testing"
+)
+
+func TestStrongestSupportedPicksFirstMutualMatch(t *testing.T) {
+	name, constructor, err := strongestSupported([]string{"blake3", "sha256", "sha1"})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if name != "sha256" {
+		t.Errorf("expected sha256 to be selected, got %q", name)
+	}
+	if constructor == nil {
+		t.Error("expected a non-nil constructor")
+	}
+}
+
+func TestStrongestSupportedNoMutualMatch(t *testing.T) {
+	if _, _, err := strongestSupported([]string{"blake3"}); err == nil {
+		t.Error("expected an error when no hash algorithm is mutually supported")
+	}
+}
+
+func TestRegisterHashMakesAlgorithmNegotiable(t *testing.T) {
+	RegisterHash("md5-for-test", md5.New)
+
+	name, constructor, err := strongestSupported([]string{"md5-for-test"})
+	if err != nil {
+		t.Fatal("registered hash algorithm was not found by strongestSupported:", err)
+	}
+	if name != "md5-for-test" {
+		t.Errorf("expected md5-for-test to be selected, got %q", name)
+	}
+	if constructor().Size() != md5.Size {
+		t.Error("constructor did not return an md5 hash")
+	}
+}
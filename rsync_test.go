@@ -10,6 +10,7 @@ import (
 	"os"
 	"net"
 	"crypto/sha1"
+	"context"
 )
 
 const (
@@ -82,13 +83,18 @@ func TestSyncing(t *testing.T) {
 	}()
 
 	// Create a client.
-	client := NewClient(target, target, sha1.New(), clientConnection)
+	client, err := NewClient(target, target, clientConnection, nil)
+	if err != nil {
+		server.Close()
+		<-serverErrors
+		t.Fatal("unable to create client:", err)
+	}
 
 	// Compute the paths that we want to stage.
 	paths := []Path{exePath("go"), exePath("godoc"), exePath("gofmt")}
 
 	// Perform staging.
-	if err = client.Stage(paths); err != nil {
+	if err = client.Stage(context.Background(), paths, StageOptions{}); err != nil {
 		server.Close()
 		<-serverErrors
 		t.Fatal("unable to stage paths:", err)
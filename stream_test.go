@@ -0,0 +1,119 @@
+package rsync
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// bufferConn adapts a bytes.Buffer into an io.ReadWriteCloser for testing
+// frameConn without a real network connection.
+type bufferConn struct {
+	bytes.Buffer
+}
+
+func (bufferConn) Close() error {
+	return nil
+}
+
+func TestFrameConnRoundTrip(t *testing.T) {
+	conn := &bufferConn{}
+	frames := newFrameConn(conn, streamConfig{
+		compressor:     noneCompressor{},
+		maxMessageSize: defaultMaxMessageSize,
+	})
+
+	messages := []string{"first frame", "a rather longer second frame", "3rd"}
+	for _, message := range messages {
+		if _, err := frames.Write([]byte(message)); err != nil {
+			t.Fatal("write failed:", err)
+		}
+	}
+
+	for _, expected := range messages {
+		buf := make([]byte, len(expected))
+		if _, err := io.ReadFull(frames, buf); err != nil {
+			t.Fatal("read failed:", err)
+		}
+		if string(buf) != expected {
+			t.Errorf("expected %q, got %q", expected, string(buf))
+		}
+	}
+}
+
+func TestFrameConnSkipsOversizedFrames(t *testing.T) {
+	conn := &bufferConn{}
+	writer := newFrameConn(conn, streamConfig{
+		compressor:     noneCompressor{},
+		maxMessageSize: defaultMaxMessageSize,
+	})
+
+	// Write a frame that's oversized for the reader below (the writer's own
+	// limit is the larger default) followed by a normal one, to exercise the
+	// reader's skip path.
+	oversized := make([]byte, 128)
+	if _, err := writer.Write(oversized); err != nil {
+		t.Fatal("write failed:", err)
+	}
+	if _, err := writer.Write([]byte("ok")); err != nil {
+		t.Fatal("write failed:", err)
+	}
+
+	metrics := &StreamMetrics{}
+	reader := newFrameConn(conn, streamConfig{
+		compressor:     noneCompressor{},
+		maxMessageSize: 64,
+		metrics:        metrics,
+	})
+
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		t.Fatal("read failed:", err)
+	}
+	if string(buf) != "ok" {
+		t.Errorf("expected the oversized frame to be skipped and \"ok\" returned, got %q", string(buf))
+	}
+	if metrics.FramesSkipped != 1 {
+		t.Errorf("expected exactly one frame to be skipped, got %d", metrics.FramesSkipped)
+	}
+}
+
+func TestFrameConnGzipRoundTrip(t *testing.T) {
+	conn := &bufferConn{}
+	frames := newFrameConn(conn, streamConfig{
+		compressor:     gzipCompressor{},
+		maxMessageSize: defaultMaxMessageSize,
+	})
+
+	message := "compress me, please"
+	if _, err := frames.Write([]byte(message)); err != nil {
+		t.Fatal("write failed:", err)
+	}
+
+	buf := make([]byte, len(message))
+	if _, err := io.ReadFull(frames, buf); err != nil {
+		t.Fatal("read failed:", err)
+	}
+	if string(buf) != message {
+		t.Errorf("expected %q, got %q", message, string(buf))
+	}
+}
+
+func TestStrongestSupportedCompressorPicksFirstMutualMatch(t *testing.T) {
+	name, compressor, err := strongestSupportedCompressor([]string{"zstd", "gzip", "none"})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if name != "gzip" {
+		t.Errorf("expected gzip to be selected, got %q", name)
+	}
+	if compressor == nil {
+		t.Error("expected a non-nil compressor")
+	}
+}
+
+func TestStrongestSupportedCompressorNoMutualMatch(t *testing.T) {
+	if _, _, err := strongestSupportedCompressor([]string{"zstd"}); err == nil {
+		t.Error("expected an error when no compression scheme is mutually supported")
+	}
+}